@@ -0,0 +1,166 @@
+// Copyright 2020 Alexey Krivonogov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"eonza/lib"
+	es "eonza/script"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NodeErrors pairs a tree node with the parameter validation problems
+// ScriptValues would raise for it, collected without aborting at the
+// first failure so every issue in a script can be reported at once.
+type NodeErrors struct {
+	IdName string   `json:"idname"`
+	Errors []string `json:"errors"`
+}
+
+// CompiledInfo is the payload served by GET /api/script/:name/compiled.
+// It mirrors the router-tree introspection admin dashboards expose: the
+// generated source plus enough structure to debug it without running
+// the script.
+type CompiledInfo struct {
+	Source    string              `json:"source"`
+	Strings   map[string]string   `json:"strings"`    // STR<id> -> value
+	StringCRC map[string]uint64   `json:"string_crc"` // STR<id> -> crc64 key
+	Linked    []string            `json:"linked"`
+	Errors    []NodeErrors        `json:"errors"`
+	CallGraph map[string][]string `json:"call_graph"`
+}
+
+// CompiledHandler implements GET /api/script/:name/compiled: the
+// generated source, string constant table, linked sub-scripts,
+// per-node validation errors and call graph for a script.
+func CompiledHandler(c echo.Context) error {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	name := c.Param(`name`)
+	script := getScript(name)
+	if script == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{`error`: fmt.Sprintf(Lang(DefLang, `erropen`), name)})
+	}
+	var header es.Header
+	if err := c.Bind(&header); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{`error`: err.Error()})
+	}
+	source, src, err := genSourceTree(script, &header)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, echo.Map{`error`: err.Error(),
+			`errors`: src.CollectErrors(script.Tree)})
+	}
+	linked := make([]string, 0, len(src.Linked))
+	for idname := range src.Linked {
+		linked = append(linked, idname)
+	}
+	strValues := make(map[string]string, len(src.Strings))
+	for id, val := range src.Strings {
+		strValues[fmt.Sprintf(`STR%d`, id)] = val
+	}
+	strCRC := make(map[string]uint64, len(src.HashStrings))
+	for crc, id := range src.HashStrings {
+		strCRC[fmt.Sprintf(`STR%d`, id)] = crc
+	}
+	return c.JSON(http.StatusOK, CompiledInfo{
+		Source:    source,
+		Strings:   strValues,
+		StringCRC: strCRC,
+		Linked:    linked,
+		Errors:    src.CollectErrors(script.Tree),
+		CallGraph: src.CallGraph(script.Tree),
+	})
+}
+
+// CollectErrors walks tree and the children of its nodes as Source.Tree
+// does but, instead of stopping at the first invalid node, records every
+// required-field violation it finds so CompiledHandler can report them
+// all together. Unlike Source.Tree it does not descend into the trees of
+// the scripts those nodes call.
+func (src *Source) CollectErrors(tree []scriptTree) []NodeErrors {
+	var out []NodeErrors
+	for _, node := range tree {
+		if node.Disable {
+			continue
+		}
+		script := getScript(node.Name)
+		if script == nil {
+			out = append(out, NodeErrors{IdName: lib.IdName(node.Name),
+				Errors: []string{fmt.Sprintf(Lang(DefLang, `erropen`), node.Name)}})
+			continue
+		}
+		var errs []string
+		for _, par := range script.Params {
+			if !par.Options.Required {
+				continue
+			}
+			val := node.Values[par.Name]
+			value := ``
+			if val != nil {
+				value = strings.TrimSpace(fmt.Sprint(val))
+			}
+			switch par.Type {
+			case PTextarea, PSingleText, PNumber:
+				if len(value) == 0 {
+					errs = append(errs, par.Title)
+				}
+			case PList:
+				if reflect.TypeOf(val) == nil || reflect.TypeOf(val).Kind() != reflect.Slice ||
+					reflect.ValueOf(val).Len() == 0 {
+					errs = append(errs, par.Title)
+				}
+			}
+		}
+		if len(errs) > 0 {
+			out = append(out, NodeErrors{IdName: lib.IdName(script.Settings.Name), Errors: errs})
+		}
+		out = append(out, src.CollectErrors(node.Children)...)
+	}
+	return out
+}
+
+// scriptLookup resolves a script by node name, overridden in tests so
+// CallGraph's cycle handling can be exercised without the real registry.
+var scriptLookup = getScript
+
+// CallGraph walks tree the same way Source.Tree does and returns, for
+// every idname it calls, the idnames that call reaches in turn -
+// flattened across the whole script so circular references between
+// macros are visible at a glance. A visited set (mirroring src.Linked in
+// Source.Script) stops it recursing forever when two scripts call each
+// other - the exact case this graph exists to surface.
+func (src *Source) CallGraph(tree []scriptTree) map[string][]string {
+	graph := make(map[string][]string)
+	visited := make(map[string]bool)
+	var walk func(tree []scriptTree, parent string)
+	walk = func(tree []scriptTree, parent string) {
+		for _, node := range tree {
+			if node.Disable {
+				continue
+			}
+			script := scriptLookup(node.Name)
+			if script == nil {
+				continue
+			}
+			idname := lib.IdName(script.Settings.Name)
+			if len(parent) > 0 {
+				graph[parent] = append(graph[parent], idname)
+			}
+			if visited[idname] {
+				continue
+			}
+			visited[idname] = true
+			walk(node.Children, idname)
+			walk(script.Tree, idname)
+		}
+	}
+	walk(tree, ``)
+	return graph
+}
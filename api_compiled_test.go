@@ -0,0 +1,40 @@
+// Copyright 2020 Alexey Krivonogov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCallGraphCycle guards against the infinite-recursion regression
+// fixed in CallGraph's visited set: two scripts that call each other
+// must still return, not recurse forever.
+func TestCallGraphCycle(t *testing.T) {
+	a := &Script{Tree: []scriptTree{{Name: `b`}}}
+	a.Settings.Name = `a`
+	b := &Script{Tree: []scriptTree{{Name: `a`}}}
+	b.Settings.Name = `b`
+
+	byName := map[string]*Script{`a`: a, `b`: b}
+	prev := scriptLookup
+	scriptLookup = func(name string) *Script { return byName[name] }
+	defer func() { scriptLookup = prev }()
+
+	done := make(chan map[string][]string, 1)
+	go func() {
+		src := &Source{}
+		done <- src.CallGraph(a.Tree)
+	}()
+
+	select {
+	case graph := <-done:
+		if len(graph) == 0 {
+			t.Fatal(`expected a non-empty call graph`)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`CallGraph did not return - likely recursing on the a<->b cycle`)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 Alexey Krivonogov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// apiAuth gates the introspection and run-log endpoints behind the
+// bearer token configured in cfg.API.Token.
+func apiAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := strings.TrimPrefix(c.Request().Header.Get(`Authorization`), `Bearer `)
+		if len(cfg.API.Token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.API.Token)) != 1 {
+			return c.JSON(http.StatusUnauthorized, echo.Map{`error`: `unauthorized`})
+		}
+		return next(c)
+	}
+}
+
+// RegisterAPIRoutes wires the compiled-script introspection endpoint and
+// the per-run JSON log stream/replay endpoints onto the echo instance
+// RunServer returns, both behind apiAuth.
+func RegisterAPIRoutes(e *echo.Echo) {
+	api := e.Group(`/api`, apiAuth)
+	api.GET(`/script/:name/compiled`, CompiledHandler)
+	api.GET(`/run/:id/log`, RunLogHandler)
+	api.GET(`/run/:id/replay`, RunReplayHandler)
+}
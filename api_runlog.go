@@ -0,0 +1,56 @@
+// Copyright 2020 Alexey Krivonogov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+
+	"eonza/script"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// RunLogHandler implements GET /api/run/:id/log: it upgrades to a
+// websocket and streams the JSON log records for the given run_id as they
+// are written by the configured JSON sink, in the same {ts, level,
+// run_id, script, node, msg, vars} shape as the file, so external
+// observers such as CI or dashboards can tail a specific execution
+// without polling or regex-parsing the text log. A connection that falls
+// more than 32 records behind misses the records written meanwhile.
+func RunLogHandler(c echo.Context) error {
+	sink := script.JSONLogSink()
+	if sink == nil {
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{`error`: `json log sink is not configured`})
+	}
+	runID := c.Param(`id`)
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		ch := sink.Subscribe(runID)
+		defer sink.Unsubscribe(ch)
+		for rec := range ch {
+			if err := websocket.JSON.Send(ws, rec); err != nil {
+				return
+			}
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// RunReplayHandler implements GET /api/run/:id/replay: it reads the
+// JSON log file for a completed run and returns every record for it in
+// the same wire shape RunLogHandler streams, for clients that connect
+// after the run has already finished.
+func RunReplayHandler(c echo.Context) error {
+	sink := script.JSONLogSink()
+	if sink == nil {
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{`error`: `json log sink is not configured`})
+	}
+	records, err := sink.Replay(c.Param(`id`))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{`error`: err.Error()})
+	}
+	return c.JSON(http.StatusOK, records)
+}
@@ -263,6 +263,16 @@ func ValToStr(input string) string {
 }
 
 func GenSource(script *Script, header *es.Header) (string, error) {
+	source, _, err := genSourceTree(script, header)
+	return source, err
+}
+
+// genSourceTree does the work of GenSource but also returns the Source
+// used to build it, so callers that need the constant pool, the linked
+// sub-scripts or the call graph alongside the generated text - such as
+// the compiled-script introspection endpoint - don't have to regenerate
+// it from scratch.
+func genSourceTree(script *Script, header *es.Header) (string, *Source, error) {
 	var params string
 	src := &Source{
 		Linked:      make(map[string]bool),
@@ -272,7 +282,7 @@ func GenSource(script *Script, header *es.Header) (string, error) {
 	}
 	values, err := src.ScriptValues(script, scriptTree{})
 	if err != nil {
-		return ``, err
+		return ``, src, err
 	}
 	for _, par := range values {
 		val := par.Value
@@ -291,13 +301,13 @@ func GenSource(script *Script, header *es.Header) (string, error) {
 		code += "\r\n"
 	}
 	if predef, err := src.Predefined(script); err != nil {
-		return ``, err
+		return ``, src, err
 	} else {
 		code = predef + code
 	}
 	body, err := src.Tree(script.Tree)
 	if err != nil {
-		return ``, err
+		return ``, src, err
 	}
 	var constStr string
 	if len(src.Strings) > 0 {
@@ -311,5 +321,5 @@ func GenSource(script *Script, header *es.Header) (string, error) {
 	LOG_ERROR LOG_WARN LOG_FORM LOG_INFO LOG_DEBUG }
 `
 	return fmt.Sprintf("%s%s\r\nrun {\r\n%s%s%s\r\ndeinit()}", constStr, src.Funcs, params,
-		code, body), nil
+		code, body), src, nil
 }
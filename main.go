@@ -6,9 +6,14 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,8 +26,61 @@ import (
 var (
 	stopchan   = make(chan os.Signal)
 	scriptTask *script.Script
+	draining   int32
 )
 
+// defaultShutdownTimeout is used when cfg.HTTP.ShutdownTimeout is unset
+// and, for a piped script, Header.HTTP.ShutdownTimeout is unset too; it is
+// long enough for a script holding an open subprocess to unwind after
+// its run context is cancelled.
+const defaultShutdownTimeout = 30 * time.Second
+
+// Draining reports whether the server is shutting down, so the /run
+// handler can reject new requests with 503 instead of racing the task
+// registry being torn down.
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// newRunID generates the correlation id threaded through every log line
+// of one execution, so an external observer can tail or replay it by
+// run_id instead of regex-matching the text log.
+func newRunID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// wireServer registers the routes and middleware that both the server
+// and piped-script branches need on the echo instance RunServer
+// returns, so the two call sites stay in sync.
+func wireServer(e *echo.Echo) {
+	e.Use(drainMiddleware)
+	RegisterAPIRoutes(e)
+}
+
+// drainMiddleware rejects /run with 503 once a shutdown has been
+// requested, so new work doesn't race the task registry being torn
+// down while the current run is given a chance to unwind.
+func drainMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if Draining() && strings.HasPrefix(c.Request().URL.Path, `/run`) {
+			return c.JSON(http.StatusServiceUnavailable, echo.Map{`error`: `server is shutting down`})
+		}
+		return next(c)
+	}
+}
+
+func shutdownTimeout() time.Duration {
+	if IsScript && scriptTask != nil && scriptTask.Header.HTTP.ShutdownTimeout > 0 {
+		return time.Duration(scriptTask.Header.HTTP.ShutdownTimeout) * time.Second
+	}
+	if cfg.HTTP.ShutdownTimeout > 0 {
+		return time.Duration(cfg.HTTP.ShutdownTimeout) * time.Second
+	}
+	return defaultShutdownTimeout
+}
+
 func main() {
 	var e *echo.Echo
 
@@ -45,13 +103,20 @@ func main() {
 		if err = LoadCustomAsset(scriptTask.Header.AssetsDir, scriptTask.Header.HTTP.Theme); err != nil {
 			golog.Fatal(err)
 		}
+		if err = script.ConfigureSinks(scriptTask.Header.Log); err != nil {
+			golog.Fatal(err)
+		}
 		e = RunServer(WebSettings{
 			Port: scriptTask.Header.HTTP.Port,
 			Open: true,
 			Lang: scriptTask.Header.Lang,
 		})
+		wireServer(e)
 		go func() {
+			script.WithShutdown(context.Background())
 			settings := initTask()
+			runID := newRunID()
+			script.SetRunID(runID)
 			setStatus(TaskActive)
 			_, err := scriptTask.Run(settings)
 			if err == nil {
@@ -59,6 +124,7 @@ func main() {
 			} else if err.Error() == `code execution has been terminated` {
 				// TODO: added sppecial func or compare errID
 				setStatus(TaskTerminated)
+				script.PersistStatus(runID, `terminated`, err.Error())
 			} else {
 				setStatus(TaskFailed, err)
 			}
@@ -74,17 +140,55 @@ func main() {
 		if err = LoadCustomAsset(cfg.AssetsDir, cfg.HTTP.Theme); err != nil {
 			golog.Fatal(err)
 		}
+		if err = script.ConfigureSinks(cfg.Log); err != nil {
+			golog.Fatal(err)
+		}
+		if rec, err := script.LoadLastStatus(); err != nil {
+			golog.Errorf(`load last run status: %v`, err)
+		} else if rec != nil && rec.Status == `terminated` {
+			golog.Warnf(`previous run %s was terminated: %s`, rec.RunID, rec.Detail)
+		}
 		InitScripts()
+		if err = WatchConfig(); err != nil {
+			golog.Error(err)
+		}
 		e = RunServer(WebSettings{
 			Port: cfg.HTTP.Port,
 			Open: cfg.HTTP.Open,
 			Lang: appInfo.Lang,
 		})
+		wireServer(e)
+	}
+	signal.Notify(stopchan, os.Kill)
+	termchan := make(chan os.Signal, 1)
+	signal.Notify(termchan, os.Interrupt, syscall.SIGTERM)
+	hupchan := make(chan os.Signal, 1)
+	signal.Notify(hupchan, syscall.SIGHUP)
+
+	var timeoutc <-chan time.Time
+loop:
+	for {
+		select {
+		case <-hupchan:
+			golog.Info(`SIGHUP received, reloading configuration`)
+			reloadConfig()
+		case <-termchan:
+			golog.Info(`shutting down: draining new requests and cancelling the running script`)
+			atomic.StoreInt32(&draining, 1)
+			script.Cancel()
+			if scriptTask == nil {
+				break loop
+			}
+			timeoutc = time.After(shutdownTimeout())
+		case <-timeoutc:
+			golog.Warn(`shutdown timeout reached before the script terminated`)
+			break loop
+		case <-stopchan:
+			break loop
+		}
 	}
-	signal.Notify(stopchan, os.Kill, os.Interrupt, syscall.SIGTERM)
-	<-stopchan
 
-	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
 	defer cancel()
 	e.Shutdown(ctx)
 }
@@ -0,0 +1,189 @@
+// Copyright 2020 Alexey Krivonogov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kataras/golog"
+)
+
+// reloadMutex guards the shared state touched by a reload: storage,
+// cfg.HTTP.Theme and the script registry behind getScript. Handlers take
+// a read lock for the duration of a request; a reload holds the write
+// lock for its whole run, including the parse of the changed file.
+var reloadMutex sync.RWMutex
+
+// debounceWindow coalesces the burst of events an editor fires for a
+// single save (truncate, write, chmod, rename-into-place) into one
+// reload per file.
+const debounceWindow = 250 * time.Millisecond
+
+// watcher is the fsnotify watcher started by WatchConfig. Its watched set
+// is the one WatchConfig adds at startup; nothing refreshes it after the
+// scripts directory changes.
+var watcher *fsnotify.Watcher
+
+// WatchConfig watches the config file, the users file, the scripts
+// directory and the assets/theme directory for changes and reloads the
+// matching in-memory state on every debounced event.
+func WatchConfig() (err error) {
+	if watcher, err = fsnotify.NewWatcher(); err != nil {
+		return err
+	}
+	for _, path := range watchedPaths() {
+		if len(path) == 0 {
+			continue
+		}
+		if err = watcher.Add(path); err != nil {
+			golog.Errorf(`watch %s: %v`, path, err)
+		}
+	}
+	go debounceLoop(watcher)
+	return nil
+}
+
+func watchedPaths() []string {
+	return []string{
+		cfg.path,
+		cfg.UsersPath,
+		cfg.ScriptsPath,
+		cfg.AssetsDir,
+	}
+}
+
+func debounceLoop(watcher *fsnotify.Watcher) {
+	var (
+		mutex   sync.Mutex
+		pending = make(map[string]*time.Timer)
+	)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			path := event.Name
+			mutex.Lock()
+			if timer, ok := pending[path]; ok {
+				timer.Stop()
+			}
+			pending[path] = time.AfterFunc(debounceWindow, func() {
+				mutex.Lock()
+				delete(pending, path)
+				mutex.Unlock()
+				reloadPath(path)
+			})
+			mutex.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			golog.Errorf(`watcher: %v`, err)
+		}
+	}
+}
+
+// reloadPath dispatches a changed path to the reload routine that owns
+// it.
+func reloadPath(path string) {
+	switch {
+	case path == cfg.path:
+		reloadConfig()
+	case path == cfg.UsersPath:
+		reloadUsers()
+	case isUnder(path, cfg.ScriptsPath):
+		reloadScripts()
+	case isUnder(path, cfg.AssetsDir):
+		reloadAssets()
+	}
+}
+
+func isUnder(path, dir string) bool {
+	if len(dir) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != `..` && !filepath.IsAbs(rel) && rel[0] != '.'
+}
+
+// reloadConfig re-parses the config file and swaps it in under
+// reloadMutex so in-flight requests holding the read lock never see a
+// half-applied config. The lock is held across LoadConfig itself, not
+// just the bookkeeping after it, since LoadConfig writes straight into
+// the shared cfg global. A parse error is logged and the previous
+// config stays active.
+func reloadConfig() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	prevTheme := cfg.HTTP.Theme
+	if err := LoadConfig(); err != nil {
+		golog.Errorf(`reload config %s: %v`, cfg.path, err)
+		return
+	}
+	if err := LoadCustomAsset(cfg.AssetsDir, cfg.HTTP.Theme); err != nil {
+		golog.Errorf(`reload theme %s: %v`, cfg.HTTP.Theme, err)
+		cfg.HTTP.Theme = prevTheme
+		return
+	}
+	golog.Infof(`config reloaded: %s, theme %s -> %s`, cfg.path, prevTheme, cfg.HTTP.Theme)
+}
+
+// reloadUsers re-parses the users file and swaps the registry in under
+// reloadMutex and logs the change in the number of accounts: a growth is
+// logged as added and a shrink as removed, so a reload that adds one
+// account and removes another logs 0 added, 0 removed.
+func reloadUsers() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	before := len(users)
+	if err := LoadUsers(); err != nil {
+		golog.Errorf(`reload users: %v`, err)
+		return
+	}
+	after := len(users)
+	golog.Infof(`users reloaded: %d added, %d removed`, max(0, after-before), max(0, before-after))
+}
+
+// reloadScripts re-walks the scripts directory and swaps the registry
+// getScript reads from under reloadMutex and logs the change in the
+// number of scripts: a growth is logged as added and a shrink as removed,
+// so a reload that adds one script and removes another logs 0 and 0.
+func reloadScripts() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	before := len(scripts)
+	if err := InitScripts(); err != nil {
+		golog.Errorf(`reload scripts: %v`, err)
+		return
+	}
+	after := len(scripts)
+	golog.Infof(`scripts reloaded: %d added, %d removed`, max(0, after-before), max(0, before-after))
+}
+
+// reloadAssets re-applies the custom assets/theme directory under
+// reloadMutex, rolling back to the previous theme on error.
+func reloadAssets() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	if err := LoadCustomAsset(cfg.AssetsDir, cfg.HTTP.Theme); err != nil {
+		golog.Errorf(`reload assets %s: %v`, cfg.AssetsDir, err)
+		return
+	}
+	golog.Infof(`assets reloaded: %s`, cfg.AssetsDir)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
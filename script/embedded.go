@@ -29,11 +29,22 @@ const (
 	ErrVarDeep = `maximum depth reached`
 )
 
+// Frame is the script/node pair active at one level of nesting, pushed
+// by Init and popped by Deinit so a log line can record which script and
+// which node it came from.
+type Frame struct {
+	Script string
+	Node   string
+}
+
 type Data struct {
 	LogLevel int64
 	Vars     []map[string]string
+	Frames   []Frame
+	RunID    string
 	Mutex    sync.Mutex
-	chLogout chan string
+	sinks    []Sink
+	lastCmd  string
 }
 
 var (
@@ -53,15 +64,29 @@ func Deinit() {
 	dataScript.Mutex.Lock()
 	defer dataScript.Mutex.Unlock()
 	dataScript.Vars = dataScript.Vars[:len(dataScript.Vars)-1]
+	if len(dataScript.Frames) > 0 {
+		dataScript.Frames = dataScript.Frames[:len(dataScript.Frames)-1]
+	}
 }
 
 func Init() {
 	dataScript.Mutex.Lock()
 	defer dataScript.Mutex.Unlock()
 	dataScript.Vars = append(dataScript.Vars, make(map[string]string))
+	dataScript.Frames = append(dataScript.Frames, Frame{Script: dataScript.lastCmd})
 }
 
 func InitCmd(name string, pars ...interface{}) bool {
+	if Draining() {
+		LogOutput(LOG_WARN, fmt.Sprintf("=> %s(...) skipped: shutdown in progress", name))
+		return false
+	}
+	dataScript.Mutex.Lock()
+	dataScript.lastCmd = name
+	if n := len(dataScript.Frames); n > 0 {
+		dataScript.Frames[n-1].Node = name
+	}
+	dataScript.Mutex.Unlock()
 	params := make([]string, len(pars))
 	for i, par := range pars {
 		switch par.(type) {
@@ -75,18 +100,41 @@ func InitCmd(name string, pars ...interface{}) bool {
 	return true
 }
 
+// LogOutput formats and fans out one log line. Sink I/O runs unlocked,
+// after the dataScript snapshot below.
 func LogOutput(level int64, message string) {
-	var mode = []string{``, `ERROR`, `WARN`, `INFO`, `DEBUG`}
 	if level < LOG_ERROR || level > LOG_DEBUG {
 		return
 	}
 	dataScript.Mutex.Lock()
-	defer dataScript.Mutex.Unlock()
 	if level > dataScript.LogLevel {
+		dataScript.Mutex.Unlock()
 		return
 	}
-	dataScript.chLogout <- fmt.Sprintf("[%s] %s %s",
-		mode[level], time.Now().Format(`2006/01/02 15:04:05`), message)
+	entry := LogEntry{
+		Time:    time.Now(),
+		Level:   level,
+		RunID:   dataScript.RunID,
+		Message: message,
+	}
+	if n := len(dataScript.Frames); n > 0 {
+		entry.Script, entry.Node = dataScript.Frames[n-1].Script, dataScript.Frames[n-1].Node
+	}
+	if n := len(dataScript.Vars); n > 0 {
+		vars := dataScript.Vars[n-1]
+		entry.Vars = make(map[string]string, len(vars))
+		for k, v := range vars {
+			entry.Vars[k] = v
+		}
+	}
+	sinks := append([]Sink(nil), dataScript.sinks...)
+	dataScript.Mutex.Unlock()
+
+	for _, sink := range sinks {
+		if sink.Accept(level) {
+			sink.Write(entry)
+		}
+	}
 }
 
 func replace(values map[string]string, input []rune, stack *[]string) ([]rune, error) {
@@ -174,9 +222,23 @@ func SetVariable(name, value string) {
 	dataScript.Vars[id][name] = value
 }
 
+// InitData resets per-run state and wires the channel sink the web UI
+// reads from alongside whatever sinks were configured at startup via
+// ConfigureSinks (console, rotating file, syslog, webhook, JSON).
 func InitData(chLogout chan string) {
 	dataScript.Vars = make([]map[string]string, 0, 8)
-	dataScript.chLogout = chLogout
+	dataScript.Frames = dataScript.Frames[:0]
+	sinksMutex.RLock()
+	defer sinksMutex.RUnlock()
+	dataScript.sinks = append(append([]Sink{}, configuredSinks...), &ChanSink{MinLevel: LOG_DEBUG, Ch: chLogout})
+}
+
+// SetRunID stores the correlation id for the current run, so every log
+// line and the run-log websocket can be tied back to one execution.
+func SetRunID(id string) {
+	dataScript.Mutex.Lock()
+	defer dataScript.Mutex.Unlock()
+	dataScript.RunID = id
 }
 
 func InitEngine() error {
@@ -0,0 +1,416 @@
+// Copyright 2020 Alexey Krivonogov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package script
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogEntry is the structured record passed to every sink.
+type LogEntry struct {
+	Time    time.Time
+	Level   int64
+	RunID   string
+	Script  string
+	Node    string
+	Message string
+	Vars    map[string]string
+}
+
+var logLevelNames = []string{``, `ERROR`, `WARN`, `INFO`, `DEBUG`}
+
+// Line renders the entry the way every sink has always formatted a line.
+func (e LogEntry) Line() string {
+	return fmt.Sprintf("[%s] %s %s", logLevelNames[e.Level], e.Time.Format(`2006/01/02 15:04:05`), e.Message)
+}
+
+// Sink is a destination for log lines, accepted down to a minimum
+// severity.
+type Sink interface {
+	Accept(level int64) bool
+	Write(entry LogEntry) error
+}
+
+// SinkConfig describes one sink as loaded from cfg.Log or Header.Log.
+type SinkConfig struct {
+	Type      string // console, file, syslog, webhook, json
+	MinLevel  int64
+	Path      string // file and json sinks
+	MaxSize   int64  // file sink, rotate once the file reaches this many bytes
+	Retention int    // file sink, number of rotated files to keep
+	Address   string // syslog/webhook destination
+	VarsLevel int64  // json sink, only levels at or below this include Vars
+}
+
+var (
+	configuredSinks []Sink
+	sinksMutex      sync.RWMutex
+)
+
+// ConfigureSinks builds the sinks declared in configuration.
+func ConfigureSinks(list []SinkConfig) error {
+	sinks := make([]Sink, 0, len(list))
+	for _, item := range list {
+		sink, err := newSink(item)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+	sinksMutex.Lock()
+	configuredSinks = sinks
+	sinksMutex.Unlock()
+	return nil
+}
+
+func newSink(cfg SinkConfig) (Sink, error) {
+	switch cfg.Type {
+	case ``, `console`:
+		return &ConsoleSink{MinLevel: cfg.MinLevel}, nil
+	case `file`:
+		return NewFileSink(cfg.Path, cfg.MinLevel, cfg.MaxSize, cfg.Retention)
+	case `syslog`:
+		return &SyslogSink{MinLevel: cfg.MinLevel, Address: cfg.Address}, nil
+	case `webhook`:
+		return &WebhookSink{MinLevel: cfg.MinLevel, URL: cfg.Address}, nil
+	case `json`:
+		sink, err := NewJSONSink(cfg.Path, cfg.MinLevel, cfg.VarsLevel)
+		if err != nil {
+			return nil, err
+		}
+		activeJSONSink = sink
+		return sink, nil
+	default:
+		return nil, fmt.Errorf(`unknown sink type %q`, cfg.Type)
+	}
+}
+
+// ConsoleSink writes every accepted line to stdout.
+type ConsoleSink struct {
+	MinLevel int64
+}
+
+func (s *ConsoleSink) Accept(level int64) bool {
+	return level <= s.MinLevel
+}
+
+func (s *ConsoleSink) Write(entry LogEntry) error {
+	fmt.Println(entry.Line())
+	return nil
+}
+
+// ChanSink forwards formatted lines to a channel, the protocol the web
+// UI has always consumed.
+type ChanSink struct {
+	MinLevel int64
+	Ch       chan string
+}
+
+func (s *ChanSink) Accept(level int64) bool {
+	return level <= s.MinLevel
+}
+
+func (s *ChanSink) Write(entry LogEntry) error {
+	s.Ch <- entry.Line()
+	return nil
+}
+
+// WebhookSink POSTs each accepted line to an HTTP endpoint.
+type WebhookSink struct {
+	MinLevel int64
+	URL      string
+}
+
+func (s *WebhookSink) Accept(level int64) bool {
+	return level <= s.MinLevel
+}
+
+func (s *WebhookSink) Write(entry LogEntry) error {
+	resp, err := http.Post(s.URL, `text/plain`, strings.NewReader(entry.Line()))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// SyslogSink writes each accepted line to a remote syslog collector over
+// UDP at Address.
+type SyslogSink struct {
+	MinLevel int64
+	Address  string
+}
+
+func (s *SyslogSink) Accept(level int64) bool {
+	return level <= s.MinLevel
+}
+
+func (s *SyslogSink) Write(entry LogEntry) error {
+	conn, err := net.Dial(`udp`, s.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(entry.Line()))
+	return err
+}
+
+// FileSink appends lines to a file, rotating it past MaxSize and
+// keeping at most Retention gzip-compressed copies; with Retention zero
+// or less no copy is removed.
+type FileSink struct {
+	MinLevel  int64
+	Path      string
+	MaxSize   int64
+	Retention int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// NewFileSink opens Path for appending, creating it if necessary.
+func NewFileSink(path string, minLevel, maxSize int64, retention int) (*FileSink, error) {
+	sink := &FileSink{
+		Path:      path,
+		MinLevel:  minLevel,
+		MaxSize:   maxSize,
+		Retention: retention,
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) Accept(level int64) bool {
+	return level <= s.MinLevel
+}
+
+func (s *FileSink) Write(entry LogEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n, err := s.file.WriteString(entry.Line() + "\n")
+	if err != nil {
+		return err
+	}
+	s.size += int64(n)
+	if s.MaxSize > 0 && s.size >= s.MaxSize {
+		return s.rotate()
+	}
+	return nil
+}
+
+// rotate renames the current file aside, reopens Path and kicks off
+// background compression and pruning. The caller must hold s.mutex.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", s.Path, time.Now().Format(`20060102-150405`))
+	if err := os.Rename(s.Path, rotated); err != nil {
+		return err
+	}
+	go compressRotated(rotated)
+	go s.prune()
+	return s.open()
+}
+
+func compressRotated(path string) {
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	dst, err := os.Create(path + `.gz`)
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+	gw := gzip.NewWriter(dst)
+	if _, err = io.Copy(gw, src); err != nil {
+		gw.Close()
+		return
+	}
+	if err = gw.Close(); err != nil {
+		return
+	}
+	os.Remove(path)
+}
+
+// prune removes rotated copies of Path beyond Retention, oldest first.
+func (s *FileSink) prune() {
+	if s.Retention <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(s.Path + `.*`)
+	if err != nil {
+		return
+	}
+	sort.Strings(matches)
+	for len(matches) > s.Retention {
+		os.Remove(matches[0])
+		matches = matches[1:]
+	}
+}
+
+// activeJSONSink is the sink configured with SinkConfig.Type "json", if
+// any.
+var activeJSONSink *JSONSink
+
+// JSONLogSink returns the configured JSON sink, or nil if none was set
+// up.
+func JSONLogSink() *JSONSink {
+	return activeJSONSink
+}
+
+// LogRecord is the wire format of one JSON log line: {ts, level, run_id,
+// script, node, msg, vars}. Vars is only populated at or below
+// VarsLevel.
+type LogRecord struct {
+	Time   string            `json:"ts"`
+	Level  int64             `json:"level"`
+	RunID  string            `json:"run_id"`
+	Script string            `json:"script"`
+	Node   string            `json:"node"`
+	Msg    string            `json:"msg"`
+	Vars   map[string]string `json:"vars,omitempty"`
+}
+
+func (e LogEntry) toRecord(varsLevel int64) LogRecord {
+	rec := LogRecord{
+		Time:   e.Time.Format(time.RFC3339Nano),
+		Level:  e.Level,
+		RunID:  e.RunID,
+		Script: e.Script,
+		Node:   e.Node,
+		Msg:    e.Message,
+	}
+	if e.Level <= varsLevel {
+		rec.Vars = e.Vars
+	}
+	return rec
+}
+
+// JSONSink appends one JSON object per line to Path and fans the same
+// gated record out to any live subscribers.
+type JSONSink struct {
+	MinLevel  int64
+	VarsLevel int64
+	Path      string
+
+	mutex sync.Mutex
+	file  *os.File
+	subs  map[chan LogRecord]string // channel -> run_id filter, empty matches every run
+}
+
+// NewJSONSink opens Path for appending, creating it if necessary.
+func NewJSONSink(path string, minLevel, varsLevel int64) (*JSONSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSink{
+		MinLevel:  minLevel,
+		VarsLevel: varsLevel,
+		Path:      path,
+		file:      file,
+		subs:      make(map[chan LogRecord]string),
+	}, nil
+}
+
+func (s *JSONSink) Accept(level int64) bool {
+	return level <= s.MinLevel
+}
+
+func (s *JSONSink) Write(entry LogEntry) error {
+	rec := entry.toRecord(s.VarsLevel)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err = s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	for ch, runID := range s.subs {
+		if len(runID) > 0 && runID != entry.RunID {
+			continue
+		}
+		select {
+		case ch <- rec:
+		default: // a slow subscriber must not block logging
+		}
+	}
+	return nil
+}
+
+// Subscribe registers a channel that receives the records matching runID
+// (or every record if empty) until Unsubscribe is called. The channel
+// buffers 32 records; a record written while it is full is not sent to it.
+func (s *JSONSink) Subscribe(runID string) chan LogRecord {
+	ch := make(chan LogRecord, 32)
+	s.mutex.Lock()
+	s.subs[ch] = runID
+	s.mutex.Unlock()
+	return ch
+}
+
+// Unsubscribe removes and closes a channel returned by Subscribe.
+func (s *JSONSink) Unsubscribe(ch chan LogRecord) {
+	s.mutex.Lock()
+	delete(s.subs, ch)
+	s.mutex.Unlock()
+	close(ch)
+}
+
+// Replay reads every record logged for runID from the JSON log file.
+func (s *JSONSink) Replay(runID string) ([]LogRecord, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var out []LogRecord
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		var rec LogRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			continue
+		}
+		if rec.RunID != runID {
+			continue
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
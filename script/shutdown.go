@@ -0,0 +1,46 @@
+// Copyright 2020 Alexey Krivonogov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package script
+
+import "context"
+
+var (
+	runCtx    context.Context = context.Background()
+	runCancel context.CancelFunc
+)
+
+// WithShutdown installs the context for the current run and returns it,
+// cancelled once Cancel is called.
+func WithShutdown(parent context.Context) context.Context {
+	runCtx, runCancel = context.WithCancel(parent)
+	return runCtx
+}
+
+// Cancel requests cooperative termination of the current run, set in
+// motion by WithShutdown. Safe to call even if WithShutdown was never
+// called.
+func Cancel() {
+	if runCancel != nil {
+		runCancel()
+	}
+}
+
+// RunCtx returns the context installed by WithShutdown. Script.Run does
+// not take or check this context, and no builtin selects on it; a
+// cancellation is seen only between steps, through Draining in InitCmd.
+func RunCtx() context.Context {
+	return runCtx
+}
+
+// Draining reports whether a shutdown has been requested, so builtins
+// like InitCmd can bail out between steps instead of starting new work.
+func Draining() bool {
+	select {
+	case <-runCtx.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Alexey Krivonogov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package script
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// StatusRecord is the last known terminal status of a run, persisted
+// next to the active JSON log so a restart can report why the previous
+// run ended.
+type StatusRecord struct {
+	RunID  string    `json:"run_id"`
+	Status string    `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// statusPath derives the sidecar path from the configured JSON sink, the
+// same file this status is reported alongside.
+func statusPath() string {
+	if activeJSONSink == nil {
+		return ``
+	}
+	return activeJSONSink.Path + `.status`
+}
+
+// PersistStatus records a run's terminal status to disk so LoadLastStatus
+// can report it back after a restart. A no-op if no JSON sink is
+// configured.
+func PersistStatus(runID, status, detail string) error {
+	path := statusPath()
+	if len(path) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(StatusRecord{RunID: runID, Status: status, Detail: detail, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// LoadLastStatus reads back the status PersistStatus last wrote, or nil
+// if none is available.
+func LoadLastStatus() (*StatusRecord, error) {
+	path := statusPath()
+	if len(path) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec StatusRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}